@@ -0,0 +1,254 @@
+/* This file is part of VoltDB.
+ * Copyright (C) 2008-2016 VoltDB Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with VoltDB.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package voltdbclient
+
+import (
+	"database/sql/driver"
+	"io"
+	"testing"
+)
+
+// fakeColumnRows is a minimal driver.Rows over an in-memory table, enough to
+// drive fetchTableSchema without a real connection.
+type fakeColumnRows struct {
+	cols []string
+	rows [][]driver.Value
+	next int
+}
+
+func (r *fakeColumnRows) Columns() []string { return r.cols }
+func (r *fakeColumnRows) Close() error      { return nil }
+
+func (r *fakeColumnRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+// fakeQueryer answers @SystemCatalog COLUMNS with a canned set of rows,
+// standing in for a VoltConn/VoltCluster in tests that only exercise
+// fetchTableSchema's parsing.
+type fakeQueryer struct {
+	rows *fakeColumnRows
+}
+
+func (q *fakeQueryer) Query(procedure string, args []driver.Value) (driver.Rows, error) {
+	return q.rows, nil
+}
+
+func columnsSchemaRows() *fakeColumnRows {
+	cols := []string{"TABLE_NAME", "COLUMN_NAME", "TYPE_NAME", "ORDINAL_POSITION", "REMARKS"}
+	return &fakeColumnRows{
+		cols: cols,
+		rows: [][]driver.Value{
+			// out of order on purpose, to exercise the ORDINAL_POSITION sort.
+			{"EVENTS", "PAYLOAD", "VARBINARY", int32(2), ""},
+			{"EVENTS", "EVENT_ID", "BIGINT", int32(0), ""},
+			{"EVENTS", "USER_ID", "INTEGER", int32(1), "PARTITION_COLUMN"},
+			{"OTHER_TABLE", "ID", "BIGINT", int32(0), "PARTITION_COLUMN"},
+		},
+	}
+}
+
+// TestFetchTableSchemaFindsPartitionColumn pins down the fix for the review
+// comment that bulk loading assumed a row's partitioning value was always
+// row[0]: the partitioning column here is USER_ID at index 1, and
+// fetchTableSchema must report that index rather than 0.
+func TestFetchTableSchemaFindsPartitionColumn(t *testing.T) {
+	q := &fakeQueryer{rows: columnsSchemaRows()}
+	schema, err := fetchTableSchema(q, "EVENTS")
+	if err != nil {
+		t.Fatalf("fetchTableSchema returned error: %v", err)
+	}
+	if schema.partitionCol != 1 {
+		t.Fatalf("partitionCol = %d, want 1 (USER_ID)", schema.partitionCol)
+	}
+
+	wantNames := []string{"EVENT_ID", "USER_ID", "PAYLOAD"}
+	if len(schema.columns) != len(wantNames) {
+		t.Fatalf("got %d columns, want %d", len(schema.columns), len(wantNames))
+	}
+	for i, name := range wantNames {
+		if schema.columns[i].name != name {
+			t.Errorf("columns[%d].name = %q, want %q", i, schema.columns[i].name, name)
+		}
+	}
+	if schema.columns[1].typeTag != 5 {
+		t.Errorf("USER_ID typeTag = %d, want 5 (INTEGER)", schema.columns[1].typeTag)
+	}
+}
+
+// TestFetchTableSchemaReplicatedTable covers a table with no PARTITION_COLUMN
+// remark at all, which must come back as partitionCol -1 rather than
+// defaulting to column 0.
+func TestFetchTableSchemaReplicatedTable(t *testing.T) {
+	cols := []string{"TABLE_NAME", "COLUMN_NAME", "TYPE_NAME", "ORDINAL_POSITION", "REMARKS"}
+	q := &fakeQueryer{rows: &fakeColumnRows{
+		cols: cols,
+		rows: [][]driver.Value{
+			{"LOOKUP", "CODE", "VARCHAR", int32(0), ""},
+			{"LOOKUP", "DESCRIPTION", "VARCHAR", int32(1), ""},
+		},
+	}}
+	schema, err := fetchTableSchema(q, "LOOKUP")
+	if err != nil {
+		t.Fatalf("fetchTableSchema returned error: %v", err)
+	}
+	if schema.partitionCol != -1 {
+		t.Errorf("partitionCol = %d, want -1 for a replicated table", schema.partitionCol)
+	}
+}
+
+// TestFetchTableSchemaUnknownTable checks that a table absent from the
+// COLUMNS result is reported as an error rather than an empty schema, so
+// callers don't silently fall back to routing by row[0].
+func TestFetchTableSchemaUnknownTable(t *testing.T) {
+	q := &fakeQueryer{rows: columnsSchemaRows()}
+	if _, err := fetchTableSchema(q, "NO_SUCH_TABLE"); err == nil {
+		t.Fatal("expected an error for a table missing from @SystemCatalog COLUMNS, got nil")
+	}
+}
+
+// TestVoltTypeTagForSQLType spot-checks the TYPE_NAME -> wire tag mapping
+// encodeVoltTable and the hashinator both depend on.
+func TestVoltTypeTagForSQLType(t *testing.T) {
+	cases := []struct {
+		sqlType string
+		want    int8
+	}{
+		{"INTEGER", 5},
+		{"BIGINT", 6},
+		{"TIMESTAMP", 6},
+		{"VARCHAR", 9},
+		{"DOUBLE", 8},
+		{"VARBINARY", 25},
+		{"SOME_UNKNOWN_TYPE", 25},
+	}
+	for _, c := range cases {
+		if got := voltTypeTagForSQLType(c.sqlType); got != c.want {
+			t.Errorf("voltTypeTagForSQLType(%q) = %d, want %d", c.sqlType, got, c.want)
+		}
+	}
+}
+
+// TestEncodeVoltTableShape checks the overall byte layout encodeVoltTable
+// produces: a status byte, column count and type tags, column names, a row
+// count, and each row length-prefixed.
+func TestEncodeVoltTableShape(t *testing.T) {
+	cols := []tableColumn{
+		{name: "ID", typeTag: 5},
+		{name: "NAME", typeTag: 9},
+	}
+	rows := [][]driver.Value{
+		{int32(1), "alice"},
+		{int32(2), "bob"},
+	}
+
+	data, err := encodeVoltTable("USERS", cols, rows)
+	if err != nil {
+		t.Fatalf("encodeVoltTable returned error: %v", err)
+	}
+
+	buf := data
+	if len(buf) == 0 {
+		t.Fatal("encodeVoltTable returned no bytes")
+	}
+	if buf[0] != 0 {
+		t.Fatalf("status byte = %d, want 0", buf[0])
+	}
+	buf = buf[1:]
+
+	colCount := int16(buf[0])<<8 | int16(buf[1])
+	if colCount != int16(len(cols)) {
+		t.Fatalf("column count = %d, want %d", colCount, len(cols))
+	}
+	buf = buf[2:]
+
+	for _, c := range cols {
+		if buf[0] != byte(c.typeTag) {
+			t.Fatalf("type tag = %d, want %d", buf[0], c.typeTag)
+		}
+		buf = buf[1:]
+	}
+
+	for _, c := range cols {
+		strLen := int32(buf[0])<<24 | int32(buf[1])<<16 | int32(buf[2])<<8 | int32(buf[3])
+		buf = buf[4:]
+		if int(strLen) != len(c.name) {
+			t.Fatalf("column name length = %d, want %d", strLen, len(c.name))
+		}
+		if string(buf[:strLen]) != c.name {
+			t.Fatalf("column name = %q, want %q", buf[:strLen], c.name)
+		}
+		buf = buf[strLen:]
+	}
+
+	rowCount := int32(buf[0])<<24 | int32(buf[1])<<16 | int32(buf[2])<<8 | int32(buf[3])
+	if rowCount != int32(len(rows)) {
+		t.Fatalf("row count = %d, want %d", rowCount, len(rows))
+	}
+	buf = buf[4:]
+
+	for _, row := range rows {
+		rowLen := int32(buf[0])<<24 | int32(buf[1])<<16 | int32(buf[2])<<8 | int32(buf[3])
+		buf = buf[4:]
+		if int(rowLen) > len(buf) {
+			t.Fatalf("row length %d exceeds remaining %d bytes", rowLen, len(buf))
+		}
+		buf = buf[rowLen:]
+		_ = row
+	}
+
+	if len(buf) != 0 {
+		t.Fatalf("%d trailing bytes after decoding every row", len(buf))
+	}
+}
+
+// TestEncodeVoltTableRejectsMismatchedRow checks that a row with the wrong
+// number of values is reported as an error instead of silently encoding a
+// malformed table.
+func TestEncodeVoltTableRejectsMismatchedRow(t *testing.T) {
+	cols := []tableColumn{{name: "ID", typeTag: 5}}
+	rows := [][]driver.Value{{int32(1), "extra"}}
+	if _, err := encodeVoltTable("USERS", cols, rows); err == nil {
+		t.Fatal("expected an error for a row with the wrong column count, got nil")
+	}
+}
+
+// TestEncodeVoltTableEncodesNullUsingColumnType checks that a nil cell is
+// encoded via writeVoltNull using the column's declared type, not inferred
+// from the (absent) value - the bug fixed while implementing this function.
+func TestEncodeVoltTableEncodesNullUsingColumnType(t *testing.T) {
+	cols := []tableColumn{{name: "ID", typeTag: 5}, {name: "SCORE", typeTag: 8}}
+	rows := [][]driver.Value{{int32(1), nil}}
+	if _, err := encodeVoltTable("SCORES", cols, rows); err != nil {
+		t.Fatalf("encodeVoltTable returned error for a nil cell: %v", err)
+	}
+}
+
+// TestEncodeVoltTableNoSchema checks that encoding without a known schema
+// (e.g. a table fetchTableSchema never resolved) fails loudly rather than
+// emitting an empty, unusable VoltTable.
+func TestEncodeVoltTableNoSchema(t *testing.T) {
+	if _, err := encodeVoltTable("UNKNOWN", nil, [][]driver.Value{{int32(1)}}); err == nil {
+		t.Fatal("expected an error when no column schema is known, got nil")
+	}
+}
@@ -42,7 +42,10 @@ type connectionData struct {
 type VoltConn struct {
 	reader      io.Reader
 	writer      io.Writer
+	closer      io.Closer
 	connData    *connectionData
+	connInfo    string                    // host:port this connection was opened with, for reconnection
+	redial      func() (*VoltConn, error) // redials this connection's endpoint with the same transport/credentials
 	execs       map[int64]*VoltExecResult
 	queries     map[int64]*VoltQueryResult
 	netListener *NetworkListener
@@ -50,10 +53,11 @@ type VoltConn struct {
 	isOpen      bool
 }
 
-func newVoltConn(reader io.Reader, writer io.Writer, connData *connectionData) *VoltConn {
+func newVoltConn(reader io.Reader, writer io.Writer, closer io.Closer, connData *connectionData) *VoltConn {
 	var vc = new(VoltConn)
 	vc.reader = reader
 	vc.writer = writer
+	vc.closer = closer
 	vc.execs = make(map[int64]*VoltExecResult)
 	vc.queries = make(map[int64]*VoltQueryResult)
 	vc.nlwg = sync.WaitGroup{}
@@ -71,25 +75,38 @@ func (vc VoltConn) Close() (err error) {
 	// stop the network listener, wait for it to stop.
 	vc.netListener.stop()
 	vc.nlwg.Wait()
-	if vc.reader != nil {
-		tcpConn := vc.reader.(*net.TCPConn)
-		err = tcpConn.Close()
+	if vc.closer != nil {
+		err = vc.closer.Close()
 	}
 	vc.reader = nil
 	vc.writer = nil
+	vc.closer = nil
 	vc.connData = nil
 	vc.isOpen = false
 	return err
 }
 
-func OpenConn(connInfo string) (*VoltConn, error) {
-	// for now, at least, connInfo is host and port.
+// dialTCP resolves and dials connInfo ("host:port"). It is the shared first
+// step of every OpenConn* variant, including the ones that go on to wrap
+// the socket in TLS or a custom reader.
+func dialTCP(connInfo string) (*net.TCPConn, error) {
 	raddr, err := net.ResolveTCPAddr("tcp", connInfo)
 	if err != nil {
 		return nil, fmt.Errorf("Error resolving %v.", connInfo)
 	}
-	var tcpConn *net.TCPConn
-	if tcpConn, err = net.DialTCP("tcp", nil, raddr); err != nil {
+	return net.DialTCP("tcp", nil, raddr)
+}
+
+// openConnWrapped does everything OpenConn does, except that it lets the
+// caller see the raw socket and connectionData before NetworkListener
+// starts reading from it, by passing the *net.TCPConn through wrap (when
+// non-nil) before it is handed to newVoltConn. VoltPool and VoltCluster use
+// this to attach dead-connection detection at construction time; mutating
+// vc.reader afterward is too late, since newVoltConn has already captured
+// the original reader for the listener goroutine.
+func openConnWrapped(connInfo string, wrap func(connData *connectionData, r io.Reader) io.Reader) (*VoltConn, error) {
+	tcpConn, err := dialTCP(connInfo)
+	if err != nil {
 		return nil, err
 	}
 	login, err := serializeLoginMessage("", "")
@@ -101,7 +118,18 @@ func OpenConn(connInfo string) (*VoltConn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newVoltConn(tcpConn, tcpConn, connData), nil
+	var reader io.Reader = tcpConn
+	if wrap != nil {
+		reader = wrap(connData, tcpConn)
+	}
+	vc := newVoltConn(reader, tcpConn, tcpConn, connData)
+	vc.connInfo = connInfo
+	vc.redial = func() (*VoltConn, error) { return openConnWrapped(connInfo, wrap) }
+	return vc, nil
+}
+
+func OpenConn(connInfo string) (*VoltConn, error) {
+	return openConnWrapped(connInfo, nil)
 }
 
 func (vc VoltConn) Prepare(query string) (driver.Stmt, error) {
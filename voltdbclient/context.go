@@ -0,0 +1,146 @@
+/* This file is part of VoltDB.
+ * Copyright (C) 2008-2016 VoltDB Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with VoltDB.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package voltdbclient
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ExecContext implements driver.ExecerContext so that database/sql picks it
+// up automatically instead of falling back to Exec plus a best-effort
+// cancellation goroutine.
+func (vc VoltConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !vc.isOpen {
+		return nil, errors.New("Connection is closed")
+	}
+	handle := atomic.AddInt64(&qHandle, 1)
+	c := vc.netListener.registerExec(handle)
+	if err := vc.serializeQueryContext(ctx, vc.writer, query, handle, namedValueArgs(args)); err != nil {
+		vc.netListener.removeExec(handle)
+		return nil, err
+	}
+	select {
+	case res := <-c:
+		return res, nil
+	case <-ctx.Done():
+		vc.netListener.removeExec(handle)
+		go drainExec(c)
+		return nil, ctx.Err()
+	}
+}
+
+// QueryContext implements driver.QueryerContext so that database/sql picks
+// it up automatically instead of falling back to Query plus a best-effort
+// cancellation goroutine.
+func (vc VoltConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !vc.isOpen {
+		return nil, errors.New("Connection is closed")
+	}
+	handle := atomic.AddInt64(&qHandle, 1)
+	c := vc.netListener.registerQuery(handle)
+	if err := vc.serializeQueryContext(ctx, vc.writer, query, handle, namedValueArgs(args)); err != nil {
+		vc.netListener.removeQuery(handle)
+		return nil, err
+	}
+	select {
+	case rows := <-c:
+		return rows, nil
+	case <-ctx.Done():
+		vc.netListener.removeQuery(handle)
+		go drainQuery(c)
+		return nil, ctx.Err()
+	}
+}
+
+// namedValueArgs strips database/sql's names from args, keeping their
+// order; VoltDB procedure parameters are positional only.
+func namedValueArgs(args []driver.NamedValue) []driver.Value {
+	vals := make([]driver.Value, len(args))
+	for i, nv := range args {
+		vals[i] = nv.Value
+	}
+	return vals
+}
+
+// cancelDrainTimeout bounds how long drainExec/drainQuery wait for a
+// response that may already be in flight to a handle the listener no
+// longer has registered. It is a var, not a const, so tests can shrink it.
+var cancelDrainTimeout = 30 * time.Second
+
+// drainExec and drainQuery absorb a response that the listener may already
+// be in the middle of delivering to a canceled call's channel, racing
+// removeExec/removeQuery's removal from the listener's map. They are bounded
+// by cancelDrainTimeout rather than blocking forever: removeExec/removeQuery
+// already ran before these are spawned, so once the race window passes no
+// one will ever write to c again, and waiting on it unconditionally would
+// leak the goroutine for the lifetime of the process.
+func drainExec(c <-chan driver.Result) {
+	select {
+	case <-c:
+	case <-time.After(cancelDrainTimeout):
+	}
+}
+
+func drainQuery(c <-chan driver.Rows) {
+	select {
+	case <-c:
+	case <-time.After(cancelDrainTimeout):
+	}
+}
+
+// serializeQueryContext serializes procedure and args exactly like
+// serializeQuery, additionally threading the context's deadline, if any,
+// into the invocation header's client-side query timeout field so the
+// server can abandon long-running work on its own instead of relying solely
+// on the client to stop waiting.
+func (vc VoltConn) serializeQueryContext(ctx context.Context, writer io.Writer, procedure string, handle int64, args []driver.Value) error {
+	timeoutMs := int64(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining > 0 {
+			timeoutMs = int64(remaining / time.Millisecond)
+		}
+	}
+	if timeoutMs == 0 {
+		return vc.serializeQuery(writer, procedure, handle, args)
+	}
+	return vc.serializeQueryWithTimeout(writer, procedure, handle, args, timeoutMs)
+}
+
+// serializeQueryWithTimeout is serializeQuery's counterpart for callers that
+// have a deadline: it serializes the same invocation but with the
+// client-side query timeout field populated so the server enforces it too.
+func (vc VoltConn) serializeQueryWithTimeout(writer io.Writer, procedure string, handle int64, args []driver.Value, timeoutMs int64) error {
+	var call bytes.Buffer
+	var err error
+
+	if call, err = serializeStatementWithTimeout(procedure, handle, timeoutMs, args); err != nil {
+		return err
+	}
+
+	var netmsg bytes.Buffer
+	writeInt(&netmsg, int32(call.Len()))
+	io.Copy(&netmsg, &call)
+	io.Copy(writer, &netmsg)
+	return nil
+}
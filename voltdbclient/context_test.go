@@ -0,0 +1,79 @@
+/* This file is part of VoltDB.
+ * Copyright (C) 2008-2016 VoltDB Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with VoltDB.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package voltdbclient
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestDrainExecReturnsOnLateResponse(t *testing.T) {
+	c := make(chan driver.Result, 1)
+	c <- VoltResult{}
+
+	done := make(chan struct{})
+	go func() {
+		drainExec(c)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drainExec did not return after its channel was written to")
+	}
+}
+
+func TestDrainExecBoundedWhenNothingArrives(t *testing.T) {
+	old := cancelDrainTimeout
+	cancelDrainTimeout = 10 * time.Millisecond
+	defer func() { cancelDrainTimeout = old }()
+
+	c := make(chan driver.Result)
+	done := make(chan struct{})
+	go func() {
+		drainExec(c)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drainExec blocked forever on a channel nothing ever wrote to")
+	}
+}
+
+func TestDrainQueryBoundedWhenNothingArrives(t *testing.T) {
+	old := cancelDrainTimeout
+	cancelDrainTimeout = 10 * time.Millisecond
+	defer func() { cancelDrainTimeout = old }()
+
+	c := make(chan driver.Rows)
+	done := make(chan struct{})
+	go func() {
+		drainQuery(c)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drainQuery blocked forever on a channel nothing ever wrote to")
+	}
+}
@@ -0,0 +1,74 @@
+/* This file is part of VoltDB.
+ * Copyright (C) 2008-2016 VoltDB Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with VoltDB.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package voltdbclient
+
+import "testing"
+
+// TestMurmurHash3x64128EmptyInput pins down the one digest that can be
+// hand-verified from the algorithm definition: with seed 0 and zero-length
+// input, every mix step operates on zero, so both 64-bit halves of the
+// digest are zero and the low half this package uses is zero too.
+func TestMurmurHash3x64128EmptyInput(t *testing.T) {
+	if got := murmurHash3x64128(nil); got != 0 {
+		t.Errorf("murmurHash3x64128(nil) = %d, want 0", got)
+	}
+	if got := murmurHash3x64128([]byte{}); got != 0 {
+		t.Errorf("murmurHash3x64128([]byte{}) = %d, want 0", got)
+	}
+}
+
+// TestMurmurHash3x64128Deterministic guards against a stray use of an
+// uninitialized accumulator or non-deterministic iteration: the same input
+// must always hash to the same value.
+func TestMurmurHash3x64128Deterministic(t *testing.T) {
+	data := []byte("HELLOWORLD.insert")
+	h1 := murmurHash3x64128(data)
+	h2 := murmurHash3x64128(data)
+	if h1 != h2 {
+		t.Errorf("murmurHash3x64128 is not deterministic: %d != %d", h1, h2)
+	}
+}
+
+// TestMurmurHash3x64128Avalanche is a coarse sanity check that a hashinator
+// built on this digest will actually spread keys across partitions: a
+// single-byte change in the input must not map to the same hash.
+func TestMurmurHash3x64128Avalanche(t *testing.T) {
+	a := murmurHash3x64128([]byte{9, 0, 0, 0, 3, 'a'})
+	b := murmurHash3x64128([]byte{9, 0, 0, 0, 3, 'b'})
+	if a == b {
+		t.Errorf("murmurHash3x64128 produced identical digests for distinct inputs: %d", a)
+	}
+}
+
+// TestMurmurHash3x64128TailLengths exercises every branch of the tail
+// switch (1..15 leftover bytes), plus inputs longer than one 16-byte block,
+// and checks that no two of these lengths produce the same digest.
+func TestMurmurHash3x64128TailLengths(t *testing.T) {
+	seen := make(map[uint64]bool)
+	for n := 0; n <= 20; n++ {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i + 1)
+		}
+		h := murmurHash3x64128(data)
+		if n > 0 && seen[h] {
+			t.Errorf("length %d collided with a previously seen digest", n)
+		}
+		seen[h] = true
+	}
+}
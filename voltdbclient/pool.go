@@ -0,0 +1,353 @@
+/* This file is part of VoltDB.
+ * Copyright (C) 2008-2016 VoltDB Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with VoltDB.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package voltdbclient
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPoolClosed is returned by VoltPool methods once Close has been called.
+var ErrPoolClosed = errors.New("voltdbclient: pool is closed")
+
+// PoolOptions configures a VoltPool. Zero values fall back to the defaults
+// documented on each field.
+type PoolOptions struct {
+	// MinIdle is the number of connections NewPool opens up front. Defaults
+	// to 1. The pool does not dial again to restore this count after
+	// connections are closed or evicted.
+	MinIdle int
+	// MaxIdle is the maximum number of idle connections the pool will keep
+	// around rather than closing. Defaults to 4.
+	MaxIdle int
+	// MaxLifetime is the maximum amount of time a connection may be reused.
+	// Connections older than this are closed and replaced rather than
+	// returned to a caller. Zero means no limit.
+	MaxLifetime time.Duration
+	// PingInterval controls how often idle connections are probed with a
+	// no-op procedure call to reap sockets that were silently torn down by a
+	// NAT or load balancer. Defaults to 30s; negative disables pinging.
+	PingInterval time.Duration
+}
+
+func (o PoolOptions) withDefaults() PoolOptions {
+	if o.MinIdle <= 0 {
+		o.MinIdle = 1
+	}
+	if o.MaxIdle <= 0 {
+		o.MaxIdle = 4
+	}
+	if o.PingInterval == 0 {
+		o.PingInterval = 30 * time.Second
+	}
+	return o
+}
+
+// pooledConn wraps a VoltConn with the bookkeeping the pool needs to decide
+// whether it is still safe to hand out.
+type pooledConn struct {
+	vc      *VoltConn
+	created time.Time
+	bad     int32 // set to 1 via atomic store when a read error is observed
+}
+
+// deadConnReader marks pc bad on the first read error, so a dead socket is
+// caught by the listener goroutine instead of the next caller to use it.
+type deadConnReader struct {
+	io.Reader
+	pc *pooledConn
+}
+
+func (d *deadConnReader) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	if err != nil {
+		d.pc.markBad()
+	}
+	return n, err
+}
+
+func (pc *pooledConn) markBad() {
+	atomic.StoreInt32(&pc.bad, 1)
+}
+
+func (pc *pooledConn) isBad() bool {
+	return atomic.LoadInt32(&pc.bad) == 1
+}
+
+// VoltPool hands out connections to a single VoltDB host, evicting any
+// whose socket has been silently terminated.
+type VoltPool struct {
+	connInfo string
+	opts     PoolOptions
+
+	mu     sync.Mutex
+	idle   []*pooledConn
+	closed bool
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewPool dials connInfo and returns a VoltPool seeded with opts.MinIdle
+// connections.
+func NewPool(connInfo string, opts PoolOptions) (*VoltPool, error) {
+	opts = opts.withDefaults()
+	p := &VoltPool{
+		connInfo: connInfo,
+		opts:     opts,
+		stopCh:   make(chan struct{}),
+	}
+	for i := 0; i < opts.MinIdle; i++ {
+		pc, err := p.dial()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle = append(p.idle, pc)
+	}
+	if opts.PingInterval > 0 {
+		p.wg.Add(1)
+		go p.pingLoop()
+	}
+	return p, nil
+}
+
+// dial opens a new connection with a deadConnReader spliced in ahead of the
+// listener, so a read error is caught immediately rather than on the next
+// Exec/Query.
+func (p *VoltPool) dial() (*pooledConn, error) {
+	pc := &pooledConn{created: time.Now()}
+	vc, err := openConnWrapped(p.connInfo, func(_ *connectionData, r io.Reader) io.Reader {
+		return &deadConnReader{Reader: r, pc: pc}
+	})
+	if err != nil {
+		return nil, err
+	}
+	pc.vc = vc
+	return pc, nil
+}
+
+// get removes and returns a healthy idle connection, dialing a fresh one if
+// needed. Stale connections are closed outside p.mu so one slow teardown
+// can't stall the rest of the pool.
+func (p *VoltPool) get() (*pooledConn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return p.dial()
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if pc.isBad() || (p.opts.MaxLifetime > 0 && time.Since(pc.created) > p.opts.MaxLifetime) {
+			pc.vc.Close()
+			continue
+		}
+		return pc, nil
+	}
+}
+
+// put returns a connection to the idle list, closing it instead if it is no
+// longer healthy or the pool already has MaxIdle idle connections.
+func (p *VoltPool) put(pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || pc.isBad() || len(p.idle) >= p.opts.MaxIdle {
+		p.mu.Unlock()
+		pc.vc.Close()
+		p.mu.Lock()
+		return
+	}
+	p.idle = append(p.idle, pc)
+}
+
+func (p *VoltPool) pingLoop() {
+	defer p.wg.Done()
+	t := time.NewTicker(p.opts.PingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-t.C:
+			p.pingIdle()
+		}
+	}
+}
+
+// pingIdle pings every idle connection to reap sockets a NAT or load
+// balancer silently dropped. Each one is checked out of p.idle before the
+// ping and returned via put after, so get can't hand it out mid-ping.
+func (p *VoltPool) pingIdle() {
+	p.mu.Lock()
+	n := len(p.idle)
+	p.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		p.mu.Lock()
+		if p.closed || len(p.idle) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if _, err := pc.vc.Exec("@Ping", nil); err != nil {
+			pc.markBad()
+		}
+		p.put(pc)
+	}
+}
+
+// Exec checks out a healthy connection, executes the statement, and returns
+// the connection to the pool.
+func (p *VoltPool) Exec(query string, args []driver.Value) (driver.Result, error) {
+	pc, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.put(pc)
+	res, err := pc.vc.Exec(query, args)
+	if err != nil {
+		pc.markBad()
+	}
+	return res, err
+}
+
+// Query checks out a healthy connection, runs the query, and returns the
+// connection to the pool.
+func (p *VoltPool) Query(query string, args []driver.Value) (driver.Rows, error) {
+	pc, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.put(pc)
+	rows, err := pc.vc.Query(query, args)
+	if err != nil {
+		pc.markBad()
+	}
+	return rows, err
+}
+
+// PoolExecResult is the result of an ExecAsync issued through a VoltPool.
+// Result returns the underlying connection to the pool itself, rather than
+// a background goroutine racing the caller for VoltExecResult's
+// single-delivery channel.
+type PoolExecResult struct {
+	*VoltExecResult
+	p  *VoltPool
+	pc *pooledConn
+}
+
+// Result waits for the exec to finish, returns the connection it ran on to
+// the pool, and returns the result exactly as VoltExecResult.Result would.
+func (r *PoolExecResult) Result() (driver.Result, error) {
+	res, err := r.VoltExecResult.Result()
+	if err != nil {
+		r.pc.markBad()
+	}
+	r.p.put(r.pc)
+	return res, err
+}
+
+// PoolQueryResult is QueryAsync's counterpart to PoolExecResult.
+type PoolQueryResult struct {
+	*VoltQueryResult
+	p  *VoltPool
+	pc *pooledConn
+}
+
+// Rows waits for the query to finish, returns the connection it ran on to
+// the pool, and returns the result exactly as VoltQueryResult.Rows would.
+func (r *PoolQueryResult) Rows() (driver.Rows, error) {
+	rows, err := r.VoltQueryResult.Rows()
+	if err != nil {
+		r.pc.markBad()
+	}
+	r.p.put(r.pc)
+	return rows, err
+}
+
+// ExecAsync checks out a healthy connection and issues the statement
+// asynchronously. The connection is not returned to the pool until the
+// caller calls Result on the returned PoolExecResult.
+func (p *VoltPool) ExecAsync(query string, args []driver.Value) (*PoolExecResult, error) {
+	pc, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	ver, err := pc.vc.ExecAsync(query, args)
+	if err != nil {
+		pc.markBad()
+		p.put(pc)
+		return nil, err
+	}
+	return &PoolExecResult{VoltExecResult: ver, p: p, pc: pc}, nil
+}
+
+// QueryAsync checks out a healthy connection and issues the query
+// asynchronously. The connection is not returned to the pool until the
+// caller calls Rows on the returned PoolQueryResult.
+func (p *VoltPool) QueryAsync(query string, args []driver.Value) (*PoolQueryResult, error) {
+	pc, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	vqr, err := pc.vc.QueryAsync(query, args)
+	if err != nil {
+		pc.markBad()
+		p.put(pc)
+		return nil, err
+	}
+	return &PoolQueryResult{VoltQueryResult: vqr, p: p, pc: pc}, nil
+}
+
+// Close stops the ping loop and closes every idle connection. Connections
+// currently checked out are closed as they are returned.
+func (p *VoltPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.stopCh)
+	p.wg.Wait()
+
+	var err error
+	for _, pc := range idle {
+		if cerr := pc.vc.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+/* This file is part of VoltDB.
+ * Copyright (C) 2008-2016 VoltDB Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with VoltDB.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package voltdbclient
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPoolOptionsWithDefaults(t *testing.T) {
+	o := PoolOptions{}.withDefaults()
+	if o.MinIdle != 1 {
+		t.Errorf("MinIdle default = %d, want 1", o.MinIdle)
+	}
+	if o.MaxIdle != 4 {
+		t.Errorf("MaxIdle default = %d, want 4", o.MaxIdle)
+	}
+	if o.PingInterval <= 0 {
+		t.Errorf("PingInterval default = %v, want > 0", o.PingInterval)
+	}
+
+	custom := PoolOptions{MinIdle: 2, MaxIdle: 10}.withDefaults()
+	if custom.MinIdle != 2 || custom.MaxIdle != 10 {
+		t.Errorf("withDefaults overrode explicit values: got %+v", custom)
+	}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestDeadConnReaderMarksBadOnReadError(t *testing.T) {
+	pc := &pooledConn{}
+	d := &deadConnReader{Reader: errReader{err: errors.New("connection reset")}, pc: pc}
+
+	if pc.isBad() {
+		t.Fatal("pooledConn reported bad before any read")
+	}
+	if _, err := d.Read(make([]byte, 16)); err == nil {
+		t.Fatal("expected Read to surface the underlying error")
+	}
+	if !pc.isBad() {
+		t.Fatal("deadConnReader did not mark the pooled connection bad after a read error")
+	}
+}
+
+func TestDeadConnReaderMarksBadOnEOF(t *testing.T) {
+	pc := &pooledConn{}
+	d := &deadConnReader{Reader: errReader{err: io.EOF}, pc: pc}
+
+	if _, err := d.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("Read error = %v, want io.EOF", err)
+	}
+	if !pc.isBad() {
+		t.Fatal("deadConnReader did not mark the pooled connection bad on EOF")
+	}
+}
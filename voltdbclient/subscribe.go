@@ -0,0 +1,172 @@
+/* This file is part of VoltDB.
+ * Copyright (C) 2008-2016 VoltDB Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with VoltDB.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package voltdbclient
+
+import (
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subscriptionHandleBase reserves handles above 1<<32 for subscription
+// pushes, so NetworkListener can tell one apart from an
+// ordinary request/response handle without inspecting the payload.
+const subscriptionHandleBase int64 = 1 << 32
+
+var subHandle int64 = subscriptionHandleBase
+
+// ErrSubscriptionClosed is returned by Unsubscribe when the subscription
+// has already been torn down.
+var ErrSubscriptionClosed = errors.New("voltdbclient: subscription is closed")
+
+// reconnectBackoff is how long VoltSubscription waits between redial
+// attempts after its connection drops.
+const reconnectBackoff = 1 * time.Second
+
+// VoltSubscription is a live registration for an export stream or DR
+// conflict log topic; it delivers server-pushed rows to handler until
+// Unsubscribe is called, redialing automatically if the connection drops.
+type VoltSubscription struct {
+	topic   string
+	handle  int64
+	handler func(VoltRows)
+
+	redial func() (*VoltConn, error)
+
+	mu sync.Mutex
+	vc *VoltConn // connection @Subscribe was last issued on
+
+	closed int32 // set via atomic.CompareAndSwapInt32 by Unsubscribe
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+// Subscribe issues the @Subscribe system procedure to register interest in
+// topic (an export stream or the DR conflict log) and dispatches every
+// server-pushed row to handler on its own goroutine until Unsubscribe is
+// called.
+func (vc VoltConn) Subscribe(topic string, handler func(VoltRows)) (*VoltSubscription, error) {
+	if !vc.isOpen {
+		return nil, errors.New("Connection is closed")
+	}
+
+	handle := atomic.AddInt64(&subHandle, 1)
+	sub := &VoltSubscription{
+		topic:   topic,
+		handle:  handle,
+		handler: handler,
+		redial:  vc.redial,
+		stopCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := sub.start(&vc); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// start issues @Subscribe on vc and launches the delivery goroutine.
+func (sub *VoltSubscription) start(vc *VoltConn) error {
+	pushCh := vc.netListener.registerSubscription(sub.handle)
+	if _, err := vc.Exec("@Subscribe", []driver.Value{sub.topic, sub.handle}); err != nil {
+		vc.netListener.removeSubscription(sub.handle)
+		return err
+	}
+	sub.mu.Lock()
+	sub.vc = vc
+	sub.mu.Unlock()
+	go sub.deliver(vc, pushCh)
+	return nil
+}
+
+// deliver dispatches pushed rows to handler until stopped or pushCh closes,
+// which happens when NetworkListener sees the connection die; it then
+// redials (unless sub.redial is nil, e.g. vc wasn't opened via one of the
+// OpenConn* helpers) and re-subscribes.
+func (sub *VoltSubscription) deliver(vc *VoltConn, pushCh <-chan VoltRows) {
+	defer close(sub.done)
+	for {
+		select {
+		case <-sub.stopCh:
+			vc.netListener.removeSubscription(sub.handle)
+			return
+		case rows, ok := <-pushCh:
+			if !ok {
+				if sub.redial == nil {
+					return
+				}
+				newVC, err := sub.reconnect()
+				if err != nil {
+					return
+				}
+				vc = newVC
+				pushCh = vc.netListener.registerSubscription(sub.handle)
+				if _, err := vc.Exec("@Subscribe", []driver.Value{sub.topic, sub.handle}); err != nil {
+					return
+				}
+				sub.mu.Lock()
+				sub.vc = vc
+				sub.mu.Unlock()
+				continue
+			}
+			sub.handler(rows)
+		}
+	}
+}
+
+// reconnect calls sub.redial, retrying with a fixed backoff until it
+// succeeds or the subscription is stopped.
+func (sub *VoltSubscription) reconnect() (*VoltConn, error) {
+	for {
+		select {
+		case <-sub.stopCh:
+			return nil, ErrSubscriptionClosed
+		default:
+		}
+		vc, err := sub.redial()
+		if err == nil {
+			return vc, nil
+		}
+		time.Sleep(reconnectBackoff)
+	}
+}
+
+// Unsubscribe issues @Unsubscribe on the subscription's current connection
+// and stops delivery. Safe to call more than once; only the first call
+// does anything, later calls return ErrSubscriptionClosed.
+func (sub *VoltSubscription) Unsubscribe() error {
+	if !atomic.CompareAndSwapInt32(&sub.closed, 0, 1) {
+		return ErrSubscriptionClosed
+	}
+
+	sub.mu.Lock()
+	vc := sub.vc
+	sub.mu.Unlock()
+
+	var err error
+	if vc != nil {
+		_, err = vc.Exec("@Unsubscribe", []driver.Value{sub.topic, sub.handle})
+	}
+
+	close(sub.stopCh)
+	<-sub.done
+	return err
+}
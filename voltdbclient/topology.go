@@ -0,0 +1,582 @@
+/* This file is part of VoltDB.
+ * Copyright (C) 2008-2016 VoltDB Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with VoltDB.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package voltdbclient
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TopologyRefreshInterval is how often a VoltCluster re-learns partition
+// layout and single-partition procedure metadata from the cluster.
+const TopologyRefreshInterval = 1 * time.Minute
+
+// procInfo records what a VoltCluster knows about a procedure's
+// partitioning from @SystemCatalog PROCEDURES.
+type procInfo struct {
+	singlePartition bool
+	partitionParam  int // index into the Exec/Query args
+}
+
+// tableColumn is one column of a table's schema, in declared order, as
+// learned from @SystemCatalog COLUMNS. VoltBulkLoader needs this both to
+// encode rows into the wire VoltTable format and to find which column is
+// the partitioning key.
+type tableColumn struct {
+	name    string
+	typeTag int8
+}
+
+// tableSchema is a VoltCluster's cached view of one table: its columns in
+// order, and the index of the partitioning column, or -1 if the table is
+// replicated (or the partitioning column could not be determined).
+type tableSchema struct {
+	columns      []tableColumn
+	partitionCol int
+}
+
+// voltQueryer is satisfied by both VoltConn and VoltCluster, so schema
+// lookups and partition routing share the same code whether or not the
+// caller is topology-aware.
+type voltQueryer interface {
+	Query(procedure string, args []driver.Value) (driver.Rows, error)
+}
+
+// VoltCluster is a topology-aware client that spreads procedure calls
+// across every node in a VoltDB cluster and, for single-partition
+// procedures, routes the call directly to the partition's master node the
+// way the reference Java "smart client" does.
+type VoltCluster struct {
+	connInfo string
+
+	mu        sync.RWMutex
+	conns     map[int32]*VoltConn    // hostId -> connection to that host
+	partition map[int32]int32        // partition id -> master hostId
+	procs     map[string]procInfo    // procedure name -> partitioning info
+	schemas   map[string]tableSchema // table name (upper-cased) -> schema
+	numParts  int32
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// OpenCluster dials every host in the comma-separated seedHosts list (each
+// of the form "host:port") and returns a VoltCluster that keeps its
+// partition map fresh in the background.
+func OpenCluster(seedHosts string) (*VoltCluster, error) {
+	vcl := &VoltCluster{
+		connInfo:  seedHosts,
+		conns:     make(map[int32]*VoltConn),
+		partition: make(map[int32]int32),
+		procs:     make(map[string]procInfo),
+		schemas:   make(map[string]tableSchema),
+		stopCh:    make(chan struct{}),
+	}
+
+	for _, host := range strings.Split(seedHosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		vc, err := openConnWrapped(host, func(connData *connectionData, r io.Reader) io.Reader {
+			return &hostDeathNotifier{Reader: r, hostID: connData.hostId, vcl: vcl}
+		})
+		if err != nil {
+			vcl.Close()
+			return nil, fmt.Errorf("voltdbclient: failed to connect to seed host %v: %v", host, err)
+		}
+		vcl.conns[vc.connData.hostId] = vc
+	}
+	if len(vcl.conns) == 0 {
+		return nil, fmt.Errorf("voltdbclient: no seed hosts given")
+	}
+
+	if err := vcl.refreshTopology(); err != nil {
+		vcl.Close()
+		return nil, err
+	}
+
+	vcl.wg.Add(1)
+	go vcl.refreshLoop()
+	return vcl, nil
+}
+
+func (vcl *VoltCluster) refreshLoop() {
+	defer vcl.wg.Done()
+	t := time.NewTicker(TopologyRefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-vcl.stopCh:
+			return
+		case <-t.C:
+			vcl.refreshTopology()
+		}
+	}
+}
+
+// refreshTopology rebuilds the partitioning metadata from @SystemCatalog
+// PROCEDURES and @Statistics TOPO on any live connection.
+func (vcl *VoltCluster) refreshTopology() error {
+	vc := vcl.anyConn()
+	if vc == nil {
+		return fmt.Errorf("voltdbclient: no live connection to refresh topology")
+	}
+
+	procRows, err := vc.Query("@SystemCatalog", []driver.Value{"PROCEDURES"})
+	if err != nil {
+		return err
+	}
+	procs, err := parseProcedureCatalog(procRows)
+	if err != nil {
+		return err
+	}
+
+	topoRows, err := vc.Query("@Statistics", []driver.Value{"TOPO", int32(0)})
+	if err != nil {
+		return err
+	}
+	partition, numParts, err := parseTopoStats(topoRows)
+	if err != nil {
+		return err
+	}
+
+	vcl.mu.Lock()
+	vcl.procs = procs
+	vcl.partition = partition
+	vcl.numParts = numParts
+	vcl.mu.Unlock()
+	return nil
+}
+
+// parseProcedureCatalog reads the PROCEDURES table returned by
+// @SystemCatalog and records which procedures are single-partition and
+// which parameter carries the partitioning value.
+func parseProcedureCatalog(rows driver.Rows) (map[string]procInfo, error) {
+	procs := make(map[string]procInfo)
+	cols := rows.Columns()
+	dest := make([]driver.Value, len(cols))
+	for {
+		if err := rows.Next(dest); err != nil {
+			break
+		}
+		name, partCol := "", -1
+		for i, c := range cols {
+			switch strings.ToUpper(c) {
+			case "PROCEDURE_NAME":
+				if s, ok := dest[i].(string); ok {
+					name = s
+				}
+			case "PARTITION_PARAMETER":
+				if n, ok := dest[i].(int32); ok {
+					partCol = int(n)
+				}
+			}
+		}
+		if name != "" {
+			procs[name] = procInfo{singlePartition: partCol >= 0, partitionParam: partCol}
+		}
+	}
+	return procs, nil
+}
+
+// parseTopoStats reads the partition/master mapping out of the TOPO
+// selector of @Statistics.
+func parseTopoStats(rows driver.Rows) (map[int32]int32, int32, error) {
+	partition := make(map[int32]int32)
+	var maxPart int32 = -1
+	cols := rows.Columns()
+	dest := make([]driver.Value, len(cols))
+	for {
+		if err := rows.Next(dest); err != nil {
+			break
+		}
+		var partID, leaderHost int32 = -1, -1
+		for i, c := range cols {
+			switch strings.ToUpper(c) {
+			case "PARTITION_ID":
+				if n, ok := dest[i].(int32); ok {
+					partID = n
+				}
+			case "LEADER_HOST_ID":
+				if n, ok := dest[i].(int32); ok {
+					leaderHost = n
+				}
+			}
+		}
+		if partID >= 0 && leaderHost >= 0 {
+			partition[partID] = leaderHost
+			if partID > maxPart {
+				maxPart = partID
+			}
+		}
+	}
+	return partition, maxPart + 1, nil
+}
+
+func (vcl *VoltCluster) anyConn() *VoltConn {
+	vcl.mu.RLock()
+	defer vcl.mu.RUnlock()
+	for _, vc := range vcl.conns {
+		if vc.isOpen {
+			return vc
+		}
+	}
+	return nil
+}
+
+// connFor picks the connection that should handle procedure with the given
+// args: the master of the hashed partition for a known single-partition
+// procedure, or any live connection otherwise.
+func (vcl *VoltCluster) connFor(procedure string, args []driver.Value) *VoltConn {
+	vcl.mu.RLock()
+	info, known := vcl.procs[procedure]
+	numParts := vcl.numParts
+	vcl.mu.RUnlock()
+
+	if known && info.singlePartition && info.partitionParam < len(args) && numParts > 0 {
+		partID := vcl.partitionFor(args[info.partitionParam], numParts)
+		vcl.mu.RLock()
+		hostID, ok := vcl.partition[partID]
+		vcl.mu.RUnlock()
+		if ok {
+			vcl.mu.RLock()
+			vc, ok := vcl.conns[hostID]
+			vcl.mu.RUnlock()
+			if ok && vc.isOpen {
+				return vc
+			}
+		}
+	}
+	return vcl.anyConn()
+}
+
+// voltTypeTag is the one-byte VoltDB wire type tag for a Go value of the
+// kind driver.Value carries, matching the tags serializeStatement writes
+// for procedure parameters and encodeVoltTable writes for bulk-load rows.
+func voltTypeTag(v driver.Value) (int8, error) {
+	switch v.(type) {
+	case int8:
+		return 3, nil
+	case int16:
+		return 4, nil
+	case int32:
+		return 5, nil
+	case int64:
+		return 6, nil
+	case float64:
+		return 8, nil
+	case string:
+		return 9, nil
+	case []byte:
+		return 25, nil
+	default:
+		return 0, fmt.Errorf("voltdbclient: unsupported VoltDB value type %T", v)
+	}
+}
+
+// writeVoltValue writes v as serializeStatement would: a one-byte type tag
+// followed by its wire representation.
+func writeVoltValue(buf *bytes.Buffer, v driver.Value) error {
+	tag, err := voltTypeTag(v)
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(byte(tag))
+	return writeVoltValuePayload(buf, v)
+}
+
+// writeVoltValuePayload writes v's wire representation without the leading
+// type tag, for callers (like encodeVoltTable) that already know the
+// column's declared type and so write the tag themselves.
+func writeVoltValuePayload(buf *bytes.Buffer, v driver.Value) error {
+	switch val := v.(type) {
+	case int8:
+		buf.WriteByte(byte(val))
+	case int16:
+		writeShort(buf, val)
+	case int32:
+		writeInt(buf, val)
+	case int64:
+		writeLong(buf, val)
+	case float64:
+		writeDouble(buf, val)
+	case string:
+		writeString(buf, val)
+	case []byte:
+		buf.Write(val)
+	default:
+		return fmt.Errorf("voltdbclient: unsupported VoltDB value type %T", v)
+	}
+	return nil
+}
+
+// writeVoltNull writes the NULL sentinel for typeTag: the minimum value for
+// fixed-width numeric types, a -1 length prefix otherwise.
+func writeVoltNull(buf *bytes.Buffer, typeTag int8) error {
+	switch typeTag {
+	case 3:
+		buf.WriteByte(0x80)
+	case 4:
+		writeShort(buf, int16(-1<<15))
+	case 5:
+		writeInt(buf, int32(-1<<31))
+	case 6:
+		writeLong(buf, int64(-1<<63))
+	case 8:
+		writeDouble(buf, -1.7e+308)
+	case 9, 25:
+		writeInt(buf, -1)
+	default:
+		return fmt.Errorf("voltdbclient: no NULL representation for VoltDB type tag %d", typeTag)
+	}
+	return nil
+}
+
+// partitionFor hashes a partitioning value the way VoltDB's
+// ElasticHashinator does: MurmurHash3_x64_128 over the type-tagged
+// serialized bytes of the value, taken modulo the partition count.
+func (vcl *VoltCluster) partitionFor(v driver.Value, numParts int32) int32 {
+	var buf bytes.Buffer
+	if err := writeVoltValue(&buf, v); err != nil {
+		return 0
+	}
+	h := murmurHash3x64128(buf.Bytes())
+	return int32(h % uint64(numParts))
+}
+
+// schemaFor returns table's columns in declared order and the index of its
+// partitioning column (-1 if it is replicated), querying
+// @SystemCatalog COLUMNS once per table and caching the result.
+func (vcl *VoltCluster) schemaFor(table string) (tableSchema, error) {
+	key := strings.ToUpper(table)
+
+	vcl.mu.RLock()
+	schema, ok := vcl.schemas[key]
+	vcl.mu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	vc := vcl.anyConn()
+	if vc == nil {
+		return tableSchema{}, fmt.Errorf("voltdbclient: no live connection to look up schema for %v", table)
+	}
+	schema, err := fetchTableSchema(vc, table)
+	if err != nil {
+		return tableSchema{}, err
+	}
+
+	vcl.mu.Lock()
+	vcl.schemas[key] = schema
+	vcl.mu.Unlock()
+	return schema, nil
+}
+
+// fetchTableSchema queries @SystemCatalog COLUMNS for table's columns, in
+// ORDINAL_POSITION order, along with which one (if any) is the partitioning
+// column. q may be a plain VoltConn or a VoltCluster.
+func fetchTableSchema(q voltQueryer, table string) (tableSchema, error) {
+	rows, err := q.Query("@SystemCatalog", []driver.Value{"COLUMNS"})
+	if err != nil {
+		return tableSchema{}, err
+	}
+
+	type rawCol struct {
+		name        string
+		typeName    string
+		ordinal     int32
+		isPartition bool
+	}
+	var found []rawCol
+
+	cols := rows.Columns()
+	dest := make([]driver.Value, len(cols))
+	for {
+		if err := rows.Next(dest); err != nil {
+			break
+		}
+		var tableName, columnName, typeName, remarks string
+		var ordinal int32
+		for i, c := range cols {
+			switch strings.ToUpper(c) {
+			case "TABLE_NAME":
+				if s, ok := dest[i].(string); ok {
+					tableName = s
+				}
+			case "COLUMN_NAME":
+				if s, ok := dest[i].(string); ok {
+					columnName = s
+				}
+			case "TYPE_NAME":
+				if s, ok := dest[i].(string); ok {
+					typeName = s
+				}
+			case "ORDINAL_POSITION":
+				if n, ok := dest[i].(int32); ok {
+					ordinal = n
+				}
+			case "REMARKS":
+				if s, ok := dest[i].(string); ok {
+					remarks = s
+				}
+			}
+		}
+		if !strings.EqualFold(tableName, table) {
+			continue
+		}
+		found = append(found, rawCol{
+			name:        columnName,
+			typeName:    typeName,
+			ordinal:     ordinal,
+			isPartition: strings.Contains(strings.ToUpper(remarks), "PARTITION_COLUMN"),
+		})
+	}
+	if len(found) == 0 {
+		return tableSchema{}, fmt.Errorf("voltdbclient: table %v not found in @SystemCatalog COLUMNS", table)
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].ordinal < found[j].ordinal })
+
+	schema := tableSchema{columns: make([]tableColumn, len(found)), partitionCol: -1}
+	for i, f := range found {
+		schema.columns[i] = tableColumn{name: f.name, typeTag: voltTypeTagForSQLType(f.typeName)}
+		if f.isPartition {
+			schema.partitionCol = i
+		}
+	}
+	return schema, nil
+}
+
+// voltTypeTagForSQLType maps the TYPE_NAME strings @SystemCatalog COLUMNS
+// reports to the wire type tag writeVoltValue uses for that column.
+func voltTypeTagForSQLType(sqlType string) int8 {
+	switch strings.ToUpper(sqlType) {
+	case "TINYINT":
+		return 3
+	case "SMALLINT":
+		return 4
+	case "INTEGER":
+		return 5
+	case "BIGINT", "TIMESTAMP":
+		return 6
+	case "FLOAT", "DOUBLE":
+		return 8
+	case "VARCHAR":
+		return 9
+	default:
+		return 25 // VARBINARY and anything else travels as raw bytes.
+	}
+}
+
+// Exec routes a procedure call to the partition master that owns the
+// partitioning argument, falling back to any node for multi-partition or
+// unrecognized procedures.
+func (vcl *VoltCluster) Exec(procedure string, args []driver.Value) (driver.Result, error) {
+	vc := vcl.connFor(procedure, args)
+	if vc == nil {
+		return nil, fmt.Errorf("voltdbclient: no live connection available")
+	}
+	return vc.Exec(procedure, args)
+}
+
+// Query routes a procedure call the same way Exec does.
+func (vcl *VoltCluster) Query(procedure string, args []driver.Value) (driver.Rows, error) {
+	vc := vcl.connFor(procedure, args)
+	if vc == nil {
+		return nil, fmt.Errorf("voltdbclient: no live connection available")
+	}
+	return vc.Query(procedure, args)
+}
+
+// ExecAsync routes a procedure call the same way Exec does, asynchronously.
+func (vcl *VoltCluster) ExecAsync(procedure string, args []driver.Value) (*VoltExecResult, error) {
+	vc := vcl.connFor(procedure, args)
+	if vc == nil {
+		return nil, fmt.Errorf("voltdbclient: no live connection available")
+	}
+	return vc.ExecAsync(procedure, args)
+}
+
+// QueryAsync routes a procedure call the same way Exec does, asynchronously.
+func (vcl *VoltCluster) QueryAsync(procedure string, args []driver.Value) (*VoltQueryResult, error) {
+	vc := vcl.connFor(procedure, args)
+	if vc == nil {
+		return nil, fmt.Errorf("voltdbclient: no live connection available")
+	}
+	return vc.QueryAsync(procedure, args)
+}
+
+// hostDeathNotifier drops hostID from the cluster on the first read error,
+// so a dead node is routed around instead of only noticed on its next call.
+type hostDeathNotifier struct {
+	io.Reader
+	hostID   int32
+	vcl      *VoltCluster
+	notified int32
+}
+
+func (h *hostDeathNotifier) Read(p []byte) (int, error) {
+	n, err := h.Reader.Read(p)
+	if err != nil && atomic.CompareAndSwapInt32(&h.notified, 0, 1) {
+		// Runs on its own goroutine: dropHost closes the connection, which
+		// stops the listener goroutine running this very Read call.
+		go h.vcl.dropHost(h.hostID)
+	}
+	return n, err
+}
+
+// dropHost closes and forgets the connection to hostID and refreshes the
+// topology around the nodes still standing.
+func (vcl *VoltCluster) dropHost(hostID int32) {
+	vcl.mu.Lock()
+	vc, ok := vcl.conns[hostID]
+	if ok {
+		delete(vcl.conns, hostID)
+	}
+	vcl.mu.Unlock()
+
+	if ok {
+		vc.Close()
+	}
+	vcl.refreshTopology()
+}
+
+// Close stops the topology refresh loop and closes every connection.
+func (vcl *VoltCluster) Close() error {
+	close(vcl.stopCh)
+	vcl.wg.Wait()
+
+	vcl.mu.Lock()
+	defer vcl.mu.Unlock()
+	var err error
+	for _, vc := range vcl.conns {
+		if cerr := vc.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	vcl.conns = nil
+	return err
+}